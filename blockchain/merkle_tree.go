@@ -2,33 +2,63 @@ package blockchain
 
 import (
 	"crypto/sha256"
+	"fmt"
+
 	"github.com/EnsicoinDevs/ensicoincoin/utils"
 )
 
-func ComputeMerkleRoot(hashes []*utils.Hash) *utils.Hash {
+// ComputeMerkleRoot returns the merkle root of hashes. It rejects trees
+// where an odd-count level would need to duplicate its last leaf in a way
+// that collides with an honestly-built interior node, the CVE-2012-2459
+// duplicate-transaction attack.
+func ComputeMerkleRoot(hashes []*utils.Hash) (*utils.Hash, error) {
 	if len(hashes) == 0 {
 		hash := sha256.Sum256(nil)
-		return utils.NewHash(hash[:])
+		return utils.NewHash(hash[:]), nil
 	} // TODO: delete
 
-	for len(hashes) > 1 {
-		if len(hashes)%2 != 0 {
-			hashes = append(hashes, hashes[len(hashes)-1])
-		}
+	level := make([]*utils.Hash, len(hashes))
+	copy(level, hashes)
 
-		var leftHash *utils.Hash
-		for i, hash := range hashes {
-			if i%2 != 0 {
-				hashes[(i+1)/2] = DoubleHash(leftHash, hash)
-			} else {
-				leftHash = hash
-			}
+	var err error
+	for len(level) > 1 {
+		level, err = nextMerkleLevel(level)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	return level[0], nil
+}
+
+// padMerkleLevel duplicates level's last hash if its length is odd, the
+// usual merkle tree convention, but rejects the duplication if it would be
+// ambiguous with an honestly-built interior node (CVE-2012-2459).
+func padMerkleLevel(level []*utils.Hash) ([]*utils.Hash, error) {
+	if len(level)%2 == 0 {
+		return level, nil
+	}
+
+	if *level[len(level)-1] == *level[len(level)-2] {
+		return nil, fmt.Errorf("blockchain: ambiguous merkle tree: duplicating the last leaf would collide with an interior node (CVE-2012-2459)")
+	}
+
+	return append(level, level[len(level)-1]), nil
+}
+
+// nextMerkleLevel pads level if needed and returns the level above it.
+func nextMerkleLevel(level []*utils.Hash) ([]*utils.Hash, error) {
+	level, err := padMerkleLevel(level)
+	if err != nil {
+		return nil, err
+	}
 
-		hashes = hashes[:(len(hashes)/2)-1]
+	next := make([]*utils.Hash, len(level)/2)
+	for i := 0; i < len(level); i += 2 {
+		next[i/2] = DoubleHash(level[i], level[i+1])
 	}
 
-	return hashes[0]
+	return next, nil
 }
 
 func DoubleHash(a, b *utils.Hash) *utils.Hash {
@@ -36,3 +66,80 @@ func DoubleHash(a, b *utils.Hash) *utils.Hash {
 
 	return &hash
 }
+
+// MerkleProof is the sibling path needed to recompute a merkle root from a
+// single leaf, as used by SPV clients to verify a transaction's inclusion in
+// a block without downloading the whole block.
+type MerkleProof struct {
+	Siblings []*utils.Hash
+	// IsLeft reports, for each entry in Siblings, whether that sibling sits
+	// to the left of the hash being proven at that level (i.e. the sibling
+	// is the left operand of the next DoubleHash).
+	IsLeft []bool
+}
+
+// BuildMerkleProof returns the sibling path proving that hashes[index] is
+// included in the tree built over hashes. It rejects trees where an
+// odd-count level would need to duplicate its last leaf in a way that could
+// collide with an honestly-built interior node, the CVE-2012-2459
+// duplicate-transaction attack.
+func BuildMerkleProof(hashes []*utils.Hash, index int) (*MerkleProof, error) {
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("blockchain: cannot build a merkle proof of an empty tree")
+	}
+
+	if index < 0 || index >= len(hashes) {
+		return nil, fmt.Errorf("blockchain: index %d out of range for %d leaves", index, len(hashes))
+	}
+
+	level := make([]*utils.Hash, len(hashes))
+	copy(level, hashes)
+
+	proof := &MerkleProof{}
+	pos := index
+
+	var err error
+	for len(level) > 1 {
+		level, err = padMerkleLevel(level)
+		if err != nil {
+			return nil, err
+		}
+
+		if pos%2 == 0 {
+			proof.Siblings = append(proof.Siblings, level[pos+1])
+			proof.IsLeft = append(proof.IsLeft, false)
+		} else {
+			proof.Siblings = append(proof.Siblings, level[pos-1])
+			proof.IsLeft = append(proof.IsLeft, true)
+		}
+
+		next := make([]*utils.Hash, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			next[i/2] = DoubleHash(level[i], level[i+1])
+		}
+
+		level = next
+		pos /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof recomputes the merkle root from leaf by walking proof
+// and reports whether it matches root.
+func VerifyMerkleProof(leaf *utils.Hash, proof *MerkleProof, root *utils.Hash) bool {
+	if len(proof.Siblings) != len(proof.IsLeft) {
+		return false
+	}
+
+	current := leaf
+	for i, sibling := range proof.Siblings {
+		if proof.IsLeft[i] {
+			current = DoubleHash(sibling, current)
+		} else {
+			current = DoubleHash(current, sibling)
+		}
+	}
+
+	return *current == *root
+}
@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/EnsicoinDevs/ensicoincoin/utils"
+)
+
+func hashOf(b byte) *utils.Hash {
+	h := utils.Hash{b}
+	return &h
+}
+
+func leaves(n int) []*utils.Hash {
+	hashes := make([]*utils.Hash, n)
+	for i := range hashes {
+		hashes[i] = hashOf(byte(i + 1))
+	}
+
+	return hashes
+}
+
+func TestComputeMerkleRoot_Sizes(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8} {
+		hashes := leaves(n)
+
+		root, err := ComputeMerkleRoot(hashes)
+		if err != nil {
+			t.Fatalf("ComputeMerkleRoot(%d leaves): %v", n, err)
+		}
+
+		for i := range hashes {
+			proof, err := BuildMerkleProof(hashes, i)
+			if err != nil {
+				t.Fatalf("BuildMerkleProof(%d leaves, index %d): %v", n, i, err)
+			}
+
+			if !VerifyMerkleProof(hashes[i], proof, root) {
+				t.Fatalf("VerifyMerkleProof failed for %d leaves, index %d", n, i)
+			}
+		}
+	}
+}
+
+func TestBuildMerkleProof_IndexOutOfRange(t *testing.T) {
+	hashes := leaves(3)
+
+	if _, err := BuildMerkleProof(hashes, -1); err == nil {
+		t.Fatal("BuildMerkleProof(-1) = nil error, want error")
+	}
+
+	if _, err := BuildMerkleProof(hashes, len(hashes)); err == nil {
+		t.Fatal("BuildMerkleProof(len(hashes)) = nil error, want error")
+	}
+}
+
+func TestBuildMerkleProof_EmptyTree(t *testing.T) {
+	if _, err := BuildMerkleProof(nil, 0); err == nil {
+		t.Fatal("BuildMerkleProof(nil, 0) = nil error, want error")
+	}
+}
+
+func TestVerifyMerkleProof_RejectsWrongRoot(t *testing.T) {
+	hashes := leaves(4)
+
+	proof, err := BuildMerkleProof(hashes, 1)
+	if err != nil {
+		t.Fatalf("BuildMerkleProof: %v", err)
+	}
+
+	if VerifyMerkleProof(hashes[1], proof, hashOf(0xFF)) {
+		t.Fatal("VerifyMerkleProof accepted a proof against the wrong root")
+	}
+}
+
+// TestAmbiguousDuplication_Rejected covers the CVE-2012-2459 case: an
+// odd-count level whose last leaf already equals its sibling would, if
+// duplicated, make the resulting root ambiguous with an honestly-built
+// interior node.
+func TestAmbiguousDuplication_Rejected(t *testing.T) {
+	dup := hashOf(0x42)
+	hashes := []*utils.Hash{hashOf(0x01), dup, dup}
+
+	if _, err := ComputeMerkleRoot(hashes); err == nil {
+		t.Fatal("ComputeMerkleRoot accepted an ambiguous duplicate-leaf tree")
+	}
+
+	if _, err := BuildMerkleProof(hashes, 0); err == nil {
+		t.Fatal("BuildMerkleProof accepted an ambiguous duplicate-leaf tree")
+	}
+}
@@ -70,12 +70,34 @@ func writeOutpoint(writer io.Writer, outpoint *Outpoint) error {
 	return err
 }
 
+// readFlag reads a single flag string, rejecting a declared length over
+// opts.MaxFlagSize before allocating, the same way readTxIn/readTxOut bound
+// script lengths.
+func readFlag(reader io.Reader, opts *DecodeOptions) (string, error) {
+	length, err := ReadVarUint(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if length > opts.MaxFlagSize {
+		return "", fmt.Errorf("network: tx flag of %d bytes exceeds the %d byte limit", length, opts.MaxFlagSize)
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
 type TxIn struct {
 	PreviousOutput *Outpoint
 	Script         []byte
 }
 
-func readTxIn(reader io.Reader) (*TxIn, error) {
+func readTxIn(reader io.Reader, opts *DecodeOptions) (*TxIn, error) {
 	outpoint, err := readOutpoint(reader)
 	if err != nil {
 		return nil, err
@@ -86,6 +108,10 @@ func readTxIn(reader io.Reader) (*TxIn, error) {
 		return nil, err
 	}
 
+	if scriptLength > opts.MaxScriptSize {
+		return nil, fmt.Errorf("network: tx input script of %d bytes exceeds the %d byte limit", scriptLength, opts.MaxScriptSize)
+	}
+
 	buf := make([]byte, scriptLength)
 	_, err = io.ReadFull(reader, buf)
 	if err != nil {
@@ -122,7 +148,7 @@ func (txOut *TxOut) String() string {
 	return fmt.Sprintf("TxOut[Value: %d, Script: %v]", txOut.Value, txOut.Script)
 }
 
-func readTxOut(reader io.Reader) (*TxOut, error) {
+func readTxOut(reader io.Reader, opts *DecodeOptions) (*TxOut, error) {
 	value, err := ReadUint64(reader)
 	if err != nil {
 		return nil, err
@@ -133,6 +159,10 @@ func readTxOut(reader io.Reader) (*TxOut, error) {
 		return nil, err
 	}
 
+	if scriptLength > opts.MaxScriptSize {
+		return nil, fmt.Errorf("network: tx output script of %d bytes exceeds the %d byte limit", scriptLength, opts.MaxScriptSize)
+	}
+
 	buf := make([]byte, scriptLength)
 	_, err = io.ReadFull(reader, buf)
 	if err != nil {
@@ -165,13 +195,124 @@ type TxMessage struct {
 	Flags   []string
 	Inputs  []*TxIn
 	Outputs []*TxOut
+
+	sigMidstates *sigMidstates
+}
+
+// sigMidstates caches the three BIP143-style double-SHA256 midstates shared
+// by every per-input signature hash of a transaction, so signing N inputs
+// costs O(N) hashes instead of O(N^2).
+type sigMidstates struct {
+	hashPrevouts *utils.Hash
+	hashFlags    *utils.Hash
+	hashOutputs  *utils.Hash
 }
 
 func NewTxMessage() *TxMessage {
 	return &TxMessage{}
 }
 
+// InvalidateSigCache drops the cached sigMidstates. Call it after mutating
+// Inputs, Outputs or Flags directly; AddInput, AddOutput and AddFlag already do.
+func (msg *TxMessage) InvalidateSigCache() {
+	msg.sigMidstates = nil
+}
+
+func (msg *TxMessage) AddInput(input *TxIn) {
+	msg.Inputs = append(msg.Inputs, input)
+	msg.InvalidateSigCache()
+}
+
+func (msg *TxMessage) AddOutput(output *TxOut) {
+	msg.Outputs = append(msg.Outputs, output)
+	msg.InvalidateSigCache()
+}
+
+func (msg *TxMessage) AddFlag(flag string) {
+	msg.Flags = append(msg.Flags, flag)
+	msg.InvalidateSigCache()
+}
+
+func (msg *TxMessage) computeSigMidstates() *sigMidstates {
+	if msg.sigMidstates != nil {
+		return msg.sigMidstates
+	}
+
+	bufPrevouts := bytes.NewBuffer(nil)
+	for _, input := range msg.Inputs {
+		_ = writeOutpoint(bufPrevouts, input.PreviousOutput)
+	}
+
+	bufFlags := bytes.NewBuffer(nil)
+	for _, flag := range msg.Flags {
+		_ = WriteVarString(bufFlags, flag)
+	}
+
+	bufOutputs := bytes.NewBuffer(nil)
+	for _, output := range msg.Outputs {
+		_ = writeTxOut(bufOutputs, output)
+	}
+
+	msg.sigMidstates = &sigMidstates{
+		hashPrevouts: doubleSHA256(bufPrevouts.Bytes()),
+		hashFlags:    doubleSHA256(bufFlags.Bytes()),
+		hashOutputs:  doubleSHA256(bufOutputs.Bytes()),
+	}
+
+	return msg.sigMidstates
+}
+
+func doubleSHA256(data []byte) *utils.Hash {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	hash := utils.Hash(second)
+
+	return &hash
+}
+
+// DecodeOptions bounds the amount of work and memory TxMessage.Decode will
+// spend on a single untrusted message, so a malicious peer cannot OOM the
+// node with an oversized VarUint count or script length.
+type DecodeOptions struct {
+	MaxInputs      uint64
+	MaxOutputs     uint64
+	MaxFlags       uint64
+	MaxFlagSize    uint64
+	MaxScriptSize  uint64
+	MaxMessageSize int64
+}
+
+// DefaultDecodeOptions returns the limits TxMessage.Decode applies when no
+// explicit DecodeOptions are given, chosen to comfortably accommodate any
+// consensus-valid transaction while rejecting pathological ones.
+func DefaultDecodeOptions() *DecodeOptions {
+	return &DecodeOptions{
+		MaxInputs:      100_000,
+		MaxOutputs:     100_000,
+		MaxFlags:       256,
+		MaxFlagSize:    256,
+		MaxScriptSize:  10_000,
+		MaxMessageSize: 4 * 1024 * 1024,
+	}
+}
+
+// Decode reads msg from reader using DefaultDecodeOptions. Use
+// DecodeWithOptions to apply tighter limits, e.g. on a network socket.
 func (msg *TxMessage) Decode(reader io.Reader) error {
+	return msg.DecodeWithOptions(reader, DefaultDecodeOptions())
+}
+
+// DecodeWithOptions reads msg from reader, rejecting declared counts and
+// script sizes that exceed opts rather than allocating them.
+func (msg *TxMessage) DecodeWithOptions(reader io.Reader, opts *DecodeOptions) error {
+	if opts == nil {
+		opts = DefaultDecodeOptions()
+	}
+
+	if opts.MaxMessageSize > 0 {
+		reader = io.LimitReader(reader, opts.MaxMessageSize)
+	}
+
 	version, err := ReadUint32(reader)
 	if err != nil {
 		return err
@@ -182,10 +323,14 @@ func (msg *TxMessage) Decode(reader io.Reader) error {
 		return err
 	}
 
+	if flagsCount > opts.MaxFlags {
+		return fmt.Errorf("network: tx declares %d flags, exceeding the %d limit", flagsCount, opts.MaxFlags)
+	}
+
 	var flags []string
 
 	for i := uint64(0); i < flagsCount; i++ {
-		flag, err := ReadVarString(reader)
+		flag, err := readFlag(reader, opts)
 		if err != nil {
 			return err
 		}
@@ -198,10 +343,14 @@ func (msg *TxMessage) Decode(reader io.Reader) error {
 		return err
 	}
 
+	if inputsCount > opts.MaxInputs {
+		return fmt.Errorf("network: tx declares %d inputs, exceeding the %d limit", inputsCount, opts.MaxInputs)
+	}
+
 	var inputs []*TxIn
 
 	for i := uint64(0); i < inputsCount; i++ {
-		txIn, err := readTxIn(reader)
+		txIn, err := readTxIn(reader, opts)
 		if err != nil {
 			return err
 		}
@@ -211,15 +360,19 @@ func (msg *TxMessage) Decode(reader io.Reader) error {
 
 	outputsCount, err := ReadVarUint(reader)
 	if err != nil {
-		return nil
+		return err
+	}
+
+	if outputsCount > opts.MaxOutputs {
+		return fmt.Errorf("network: tx declares %d outputs, exceeding the %d limit", outputsCount, opts.MaxOutputs)
 	}
 
 	var outputs []*TxOut
 
 	for i := uint64(0); i < outputsCount; i++ {
-		txOut, err := readTxOut(reader)
+		txOut, err := readTxOut(reader, opts)
 		if err != nil {
-			return nil
+			return err
 		}
 
 		outputs = append(outputs, txOut)
@@ -229,6 +382,7 @@ func (msg *TxMessage) Decode(reader io.Reader) error {
 	msg.Flags = flags
 	msg.Inputs = inputs
 	msg.Outputs = outputs
+	msg.InvalidateSigCache()
 
 	return nil
 }
@@ -278,58 +432,144 @@ func (msg *TxMessage) Encode(writer io.Writer) error {
 	return nil
 }
 
-func (msg *TxMessage) Hash() *utils.Hash {
-	buf := bytes.NewBuffer(nil)
-	_ = msg.Encode(buf)
-
-	hash := utils.Hash(sha256.Sum256(buf.Bytes()))
-
-	hash = sha256.Sum256(hash[:])
+// SerializeWithoutScripts encodes msg the same way Encode does, except every
+// input's Script is written as a zero-length byte string. It is used to
+// derive an identifier that does not depend on signature scripts.
+func (msg *TxMessage) SerializeWithoutScripts(writer io.Writer) error {
+	err := WriteUint32(writer, msg.Version)
+	if err != nil {
+		return err
+	}
 
-	return &hash
-}
+	err = WriteVarUint(writer, uint64(len(msg.Flags)))
+	if err != nil {
+		return err
+	}
 
-func (msg *TxMessage) SHash(input *TxIn, value uint64) *utils.Hash {
-	buf := bytes.NewBuffer(nil)
-	_ = WriteUint32(buf, msg.Version)
-	_ = WriteVarUint(buf, uint64(len(msg.Flags)))
 	for _, flag := range msg.Flags {
-		_ = WriteVarString(buf, flag)
+		err = WriteVarString(writer, flag)
+		if err != nil {
+			return err
+		}
 	}
 
-	bufOutpoints := bytes.NewBuffer(nil) // TODO: optimize
+	err = WriteVarUint(writer, uint64(len(msg.Inputs)))
+	if err != nil {
+		return err
+	}
 
 	for _, input := range msg.Inputs {
-		_ = writeOutpoint(buf, input.PreviousOutput)
+		err = writeOutpoint(writer, input.PreviousOutput)
+		if err != nil {
+			return err
+		}
+
+		err = WriteVarUint(writer, 0)
+		if err != nil {
+			return err
+		}
 	}
 
-	hash := sha256.Sum256(bufOutpoints.Bytes())
+	err = WriteVarUint(writer, uint64(len(msg.Outputs)))
+	if err != nil {
+		return err
+	}
 
-	hash = sha256.Sum256(hash[:])
+	for _, output := range msg.Outputs {
+		err = writeTxOut(writer, output)
+		if err != nil {
+			return err
+		}
+	}
 
-	_, _ = buf.Write(hash[:])
+	return nil
+}
 
-	writeOutpoint(buf, input.PreviousOutput)
+// Hash returns the txid: a double-SHA256 over the transaction with every
+// input's Script stripped out, so it depends only on outpoints, flags,
+// outputs and version. Signing or otherwise rewriting a Script therefore
+// does not change the txid; use WTxid for an identifier sensitive to that.
+func (msg *TxMessage) Hash() *utils.Hash {
+	buf := bytes.NewBuffer(nil)
+	_ = msg.SerializeWithoutScripts(buf)
 
-	_ = WriteUint64(buf, value)
+	return doubleSHA256(buf.Bytes())
+}
 
-	bufOutputs := bytes.NewBuffer(nil) // TODO: same
+// WTxid returns the witness txid: a double-SHA256 over the full wire
+// encoding of msg, including every input's Script.
+func (msg *TxMessage) WTxid() *utils.Hash {
+	buf := bytes.NewBuffer(nil)
+	_ = msg.Encode(buf)
 
-	for _, output := range msg.Outputs {
-		_ = writeTxOut(bufOutputs, output)
-	}
+	return doubleSHA256(buf.Bytes())
+}
+
+// SigHashType selects which parts of a transaction a signature commits to,
+// mirroring the classic SIGHASH scheme. The ANYONECANPAY bit is a modifier
+// that may be OR'd onto any of the three base types.
+type SigHashType uint8
+
+const (
+	SigHashAll    SigHashType = 0x01
+	SigHashNone   SigHashType = 0x02
+	SigHashSingle SigHashType = 0x03
+
+	SigHashAnyOneCanPay SigHashType = 0x80
+)
+
+func (hashType SigHashType) baseType() SigHashType {
+	return hashType &^ SigHashAnyOneCanPay
+}
+
+func (hashType SigHashType) anyOneCanPay() bool {
+	return hashType&SigHashAnyOneCanPay != 0
+}
+
+// sigHashSingleBugSentinel is returned by SHash when SigHashSingle is used on
+// an input whose index has no matching output. It mirrors the historic
+// SIGHASH_SINGLE behaviour of yielding a fixed hash instead of panicking or
+// indexing out of range.
+var sigHashSingleBugSentinel = utils.Hash{0x01}
 
-	hash = sha256.Sum256(bufOutputs.Bytes())
+// SHash computes the BIP143-style signature hash for input inputIndex under
+// hashType, given the value of the output it spends. The preimage is
+// version || hashFlags || hashPrevouts || outpoint || value || hashOutputs ||
+// hashType, and the result is its double-SHA256.
+func (msg *TxMessage) SHash(inputIndex int, value uint64, hashType SigHashType) *utils.Hash {
+	if hashType.baseType() == SigHashSingle && inputIndex >= len(msg.Outputs) {
+		sentinel := sigHashSingleBugSentinel
+		return &sentinel
+	}
 
-	hash = sha256.Sum256(hash[:])
+	mid := msg.computeSigMidstates()
+	input := msg.Inputs[inputIndex]
 
-	_, _ = buf.Write(hash[:])
+	hashPrevouts := mid.hashPrevouts
+	if hashType.anyOneCanPay() {
+		hashPrevouts = &utils.Hash{}
+	}
 
-	shash := utils.Hash(sha256.Sum256(buf.Bytes()))
+	hashOutputs := mid.hashOutputs
+	switch hashType.baseType() {
+	case SigHashNone:
+		hashOutputs = &utils.Hash{}
+	case SigHashSingle:
+		bufOutput := bytes.NewBuffer(nil)
+		_ = writeTxOut(bufOutput, msg.Outputs[inputIndex])
+		hashOutputs = doubleSHA256(bufOutput.Bytes())
+	}
 
-	shash = sha256.Sum256(hash[:])
+	buf := bytes.NewBuffer(nil)
+	_ = WriteUint32(buf, msg.Version)
+	_, _ = buf.Write(mid.hashFlags[:])
+	_, _ = buf.Write(hashPrevouts[:])
+	_ = writeOutpoint(buf, input.PreviousOutput)
+	_ = WriteUint64(buf, value)
+	_, _ = buf.Write(hashOutputs[:])
+	_ = buf.WriteByte(byte(hashType))
 
-	return &shash
+	return doubleSHA256(buf.Bytes())
 }
 
 func (msg *TxMessage) MsgType() string {
@@ -0,0 +1,288 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/EnsicoinDevs/eccd/utils"
+)
+
+func newTestTx() *TxMessage {
+	return &TxMessage{
+		Version: 1,
+		Flags:   []string{"replace-by-fee"},
+		Inputs: []*TxIn{
+			{PreviousOutput: &Outpoint{Hash: utils.Hash{0x01}, Index: 0}, Script: []byte{0xAA}},
+			{PreviousOutput: &Outpoint{Hash: utils.Hash{0x02}, Index: 1}, Script: []byte{0xBB}},
+		},
+		Outputs: []*TxOut{
+			{Value: 1000, Script: []byte{0xCC}},
+			{Value: 2000, Script: []byte{0xDD}},
+		},
+	}
+}
+
+// referenceSHash independently re-derives the preimage spec'd in SHash's doc
+// comment (version || hashFlags || hashPrevouts || outpoint || value ||
+// hashOutputs || hashType) without going through TxMessage's cache, pinning
+// the wire format against regressions in computeSigMidstates.
+func referenceSHash(t *testing.T, msg *TxMessage, inputIndex int, value uint64, hashType SigHashType) *utils.Hash {
+	t.Helper()
+
+	if hashType.baseType() == SigHashSingle && inputIndex >= len(msg.Outputs) {
+		sentinel := sigHashSingleBugSentinel
+		return &sentinel
+	}
+
+	bufPrevouts := bytes.NewBuffer(nil)
+	for _, input := range msg.Inputs {
+		if err := writeOutpoint(bufPrevouts, input.PreviousOutput); err != nil {
+			t.Fatalf("writeOutpoint: %v", err)
+		}
+	}
+	hashPrevouts := doubleSHA256(bufPrevouts.Bytes())
+	if hashType.anyOneCanPay() {
+		hashPrevouts = &utils.Hash{}
+	}
+
+	bufFlags := bytes.NewBuffer(nil)
+	for _, flag := range msg.Flags {
+		if err := WriteVarString(bufFlags, flag); err != nil {
+			t.Fatalf("WriteVarString: %v", err)
+		}
+	}
+	hashFlags := doubleSHA256(bufFlags.Bytes())
+
+	var hashOutputs *utils.Hash
+	switch hashType.baseType() {
+	case SigHashNone:
+		hashOutputs = &utils.Hash{}
+	case SigHashSingle:
+		buf := bytes.NewBuffer(nil)
+		if err := writeTxOut(buf, msg.Outputs[inputIndex]); err != nil {
+			t.Fatalf("writeTxOut: %v", err)
+		}
+		hashOutputs = doubleSHA256(buf.Bytes())
+	default:
+		bufOutputs := bytes.NewBuffer(nil)
+		for _, output := range msg.Outputs {
+			if err := writeTxOut(bufOutputs, output); err != nil {
+				t.Fatalf("writeTxOut: %v", err)
+			}
+		}
+		hashOutputs = doubleSHA256(bufOutputs.Bytes())
+	}
+
+	buf := bytes.NewBuffer(nil)
+	_ = WriteUint32(buf, msg.Version)
+	buf.Write(hashFlags[:])
+	buf.Write(hashPrevouts[:])
+	if err := writeOutpoint(buf, msg.Inputs[inputIndex].PreviousOutput); err != nil {
+		t.Fatalf("writeOutpoint: %v", err)
+	}
+	_ = WriteUint64(buf, value)
+	buf.Write(hashOutputs[:])
+	_ = buf.WriteByte(byte(hashType))
+
+	return doubleSHA256(buf.Bytes())
+}
+
+// sigHashTypeName renders a SigHashType as a test case name; it has no
+// production equivalent.
+func sigHashTypeName(hashType SigHashType) string {
+	name := map[SigHashType]string{SigHashAll: "all", SigHashNone: "none", SigHashSingle: "single"}[hashType.baseType()]
+	if hashType.anyOneCanPay() {
+		name += "|anyonecanpay"
+	}
+
+	return name
+}
+
+func TestSHash_FixedVectors(t *testing.T) {
+	baseTypes := []SigHashType{SigHashAll, SigHashNone, SigHashSingle}
+
+	tests := []struct {
+		name       string
+		inputIndex int
+		value      uint64
+	}{
+		{"input0", 0, 1000},
+		{"input1", 1, 2000},
+	}
+
+	for _, base := range baseTypes {
+		for _, anyOneCanPay := range []bool{false, true} {
+			hashType := base
+			if anyOneCanPay {
+				hashType |= SigHashAnyOneCanPay
+			}
+
+			for _, tt := range tests {
+				name := tt.name + "/" + sigHashTypeName(hashType)
+
+				t.Run(name, func(t *testing.T) {
+					msg := newTestTx()
+
+					got := msg.SHash(tt.inputIndex, tt.value, hashType)
+					want := referenceSHash(t, newTestTx(), tt.inputIndex, tt.value, hashType)
+
+					if *got != *want {
+						t.Fatalf("SHash(%d, %d, %s) = %x, want %x", tt.inputIndex, tt.value, name, got[:], want[:])
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestSHash_SingleOutOfRangeSentinel(t *testing.T) {
+	msg := newTestTx()
+	msg.Outputs = msg.Outputs[:1] // only output index 0 exists
+
+	got := msg.SHash(1, 2000, SigHashSingle)
+	if *got != sigHashSingleBugSentinel {
+		t.Fatalf("SHash with out-of-range SIGHASH_SINGLE = %x, want sentinel %x", got[:], sigHashSingleBugSentinel[:])
+	}
+}
+
+func TestSHash_CacheInvalidatedOnMutation(t *testing.T) {
+	msg := newTestTx()
+
+	before := msg.SHash(0, 1000, SigHashAll)
+
+	msg.AddOutput(&TxOut{Value: 3000, Script: []byte{0xEE}})
+
+	after := msg.SHash(0, 1000, SigHashAll)
+
+	if *before == *after {
+		t.Fatalf("SHash unchanged after AddOutput; cached sigMidstates were not invalidated")
+	}
+}
+
+func TestTxMessage_HashInvariantUnderScriptChange(t *testing.T) {
+	msg := newTestTx()
+
+	before := msg.Hash()
+
+	msg.Inputs[0].Script = []byte{0xDE, 0xAD, 0xBE, 0xEF}
+
+	after := msg.Hash()
+
+	if *before != *after {
+		t.Fatalf("Hash() changed after editing an input Script: %x != %x", before[:], after[:])
+	}
+}
+
+func TestTxMessage_WTxidChangesWithScript(t *testing.T) {
+	msg := newTestTx()
+
+	before := msg.WTxid()
+
+	msg.Inputs[0].Script = []byte{0xDE, 0xAD, 0xBE, 0xEF}
+
+	after := msg.WTxid()
+
+	if *before == *after {
+		t.Fatalf("WTxid() did not change after editing an input Script")
+	}
+}
+
+func TestTxMessage_HashDiffersFromWTxid(t *testing.T) {
+	msg := newTestTx()
+
+	txid := msg.Hash()
+	wtxid := msg.WTxid()
+
+	if *txid == *wtxid {
+		t.Fatalf("Hash() and WTxid() matched for a transaction with non-empty scripts")
+	}
+}
+
+func TestDecode_RoundTrip(t *testing.T) {
+	msg := newTestTx()
+
+	buf := bytes.NewBuffer(nil)
+	if err := msg.Encode(buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	got := NewTxMessage()
+	if err := got.Decode(buf); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if *got.Hash() != *msg.Hash() {
+		t.Fatalf("decoded tx hash %x != original %x", got.Hash()[:], msg.Hash()[:])
+	}
+}
+
+func TestDecodeWithOptions_RejectsOversizedCounts(t *testing.T) {
+	msg := newTestTx()
+
+	buf := bytes.NewBuffer(nil)
+	if err := msg.Encode(buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	tests := []struct {
+		name string
+		opts *DecodeOptions
+	}{
+		{"max flags", &DecodeOptions{MaxFlags: 0, MaxFlagSize: 256, MaxInputs: 10, MaxOutputs: 10, MaxScriptSize: 256, MaxMessageSize: 4096}},
+		{"max inputs", &DecodeOptions{MaxFlags: 10, MaxFlagSize: 256, MaxInputs: 1, MaxOutputs: 10, MaxScriptSize: 256, MaxMessageSize: 4096}},
+		{"max outputs", &DecodeOptions{MaxFlags: 10, MaxFlagSize: 256, MaxInputs: 10, MaxOutputs: 1, MaxScriptSize: 256, MaxMessageSize: 4096}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewTxMessage()
+			if err := got.DecodeWithOptions(bytes.NewReader(encoded), tt.opts); err == nil {
+				t.Fatalf("DecodeWithOptions with %s = nil error, want error", tt.name)
+			}
+		})
+	}
+}
+
+func TestDecodeWithOptions_RejectsOversizedScriptAndFlag(t *testing.T) {
+	msg := newTestTx()
+
+	buf := bytes.NewBuffer(nil)
+	if err := msg.Encode(buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	tests := []struct {
+		name string
+		opts *DecodeOptions
+	}{
+		{"max flag size", &DecodeOptions{MaxFlags: 10, MaxFlagSize: 1, MaxInputs: 10, MaxOutputs: 10, MaxScriptSize: 256, MaxMessageSize: 4096}},
+		{"max script size", &DecodeOptions{MaxFlags: 10, MaxFlagSize: 256, MaxInputs: 10, MaxOutputs: 10, MaxScriptSize: 0, MaxMessageSize: 4096}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewTxMessage()
+			if err := got.DecodeWithOptions(bytes.NewReader(encoded), tt.opts); err == nil {
+				t.Fatalf("DecodeWithOptions with %s = nil error, want error", tt.name)
+			}
+		})
+	}
+}
+
+// FuzzTxMessageDecode feeds arbitrary byte slices, seeded with malformed
+// VarUint-shaped prefixes, straight into DecodeWithOptions to make sure a
+// hostile peer can never trigger an unbounded allocation or a panic.
+func FuzzTxMessageDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x01, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x01, 0x00, 0x00, 0x00, 0xfd, 0xff, 0xff})
+	f.Add(bytes.Repeat([]byte{0xff}, 32))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := NewTxMessage()
+		_ = msg.DecodeWithOptions(bytes.NewReader(data), DefaultDecodeOptions())
+	})
+}